@@ -0,0 +1,174 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	opentracing "github.com/opentracing/opentracing-go"
+
+	"github.com/optiopay/kafka/proto"
+)
+
+// FetchFuture represents a Fetch request that has been sent but whose
+// response has not been waited on yet. It reuses the connection's existing
+// respc bookkeeping, so issuing several futures from one goroutine does not
+// spin up any extra goroutines -- only Wait blocks.
+type FetchFuture struct {
+	c             *connection
+	correlationID int32
+	respc         chan result
+	span          opentracing.Span
+}
+
+// Wait blocks until the fetch response arrives, ctx is done, or the
+// connection is closed, decoding the response lazily rather than up front.
+// If ctx is done first, the correlation ID is removed from the connection's
+// response table without closing the underlying socket, so other in-flight
+// requests are unaffected.
+func (f *FetchFuture) Wait(ctx context.Context) (*proto.FetchResp, error) {
+	defer f.span.Finish()
+	select {
+	case res := <-f.respc:
+		if res.err != nil {
+			spanErrorf(f.span, res.err)
+			return nil, res.err
+		}
+		resp, err := proto.ReadFetchResp(bytes.NewReader(res.body))
+		spanErrorf(f.span, err)
+		return resp, err
+	case <-ctx.Done():
+		f.c.abortWaiter(f.correlationID)
+		spanErrorf(f.span, ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// FetchAsync sends req without waiting for the response, returning a future
+// the caller can Wait on whenever it is ready for the result. This lets a
+// single goroutine pipeline several independent fetches to the same broker
+// instead of blocking on each one in turn.
+// Calling this method on closed connection will always return ErrClosed.
+func (c *connection) FetchAsync(req *proto.FetchReq) (*FetchFuture, error) {
+	span := c.startSpan(context.Background(), "Fetch")
+	tagTopicPartitions(span, fetchTopicPartitions(req.Topics))
+
+	var ok bool
+	if req.CorrelationID, ok = <-c.nextID; !ok {
+		err := c.getStopErr()
+		spanErrorf(span, err)
+		span.Finish()
+		return nil, err
+	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
+
+	respc, err := c.respWaiter(req.CorrelationID)
+	if err != nil {
+		spanErrorf(span, err)
+		span.Finish()
+		return nil, fmt.Errorf("wait for response: %s", err)
+	}
+
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		c.abortWaiter(req.CorrelationID)
+		spanErrorf(span, err)
+		span.Finish()
+		return nil, err
+	}
+
+	return &FetchFuture{c: c, correlationID: req.CorrelationID, respc: respc, span: span}, nil
+}
+
+// ProduceFuture represents a Produce request that has been sent but whose
+// response has not been waited on yet.
+type ProduceFuture struct {
+	c             *connection
+	correlationID int32
+	respc         chan result
+	span          opentracing.Span
+}
+
+// Wait blocks until the produce response arrives, ctx is done, or the
+// connection is closed. Requests sent with RequiredAcksNone have no
+// response to wait for and Wait returns immediately with a nil response.
+func (f *ProduceFuture) Wait(ctx context.Context) (*proto.ProduceResp, error) {
+	if f.respc == nil {
+		// RequiredAcksNone: ProduceAsync already finished the span, since
+		// there is no response (and so no guarantee Wait is ever called).
+		return nil, nil
+	}
+	defer f.span.Finish()
+	select {
+	case res := <-f.respc:
+		if res.err != nil {
+			spanErrorf(f.span, res.err)
+			return nil, res.err
+		}
+		resp, err := proto.ReadProduceResp(bytes.NewReader(res.body))
+		spanErrorf(f.span, err)
+		return resp, err
+	case <-ctx.Done():
+		f.c.abortWaiter(f.correlationID)
+		spanErrorf(f.span, ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// ProduceAsync sends req without waiting for the response, returning a
+// future the caller can Wait on. This allows a producer to issue several
+// produce requests to the same broker in parallel from one goroutine and
+// gather the results afterwards, instead of blocking on each in turn.
+// Calling this method on closed connection will always return ErrClosed.
+// On any error the returned future is always nil: a non-nil error never
+// comes paired with a future the caller would otherwise need to know to
+// discard instead of Wait on.
+func (c *connection) ProduceAsync(req *proto.ProduceReq) (*ProduceFuture, error) {
+	span := c.startSpan(context.Background(), "Produce")
+	span.SetTag("kafka.required_acks", req.RequiredAcks)
+	tagTopicPartitions(span, produceTopicPartitions(req.Topics))
+
+	var ok bool
+	if req.CorrelationID, ok = <-c.nextID; !ok {
+		err := c.getStopErr()
+		spanErrorf(span, err)
+		span.Finish()
+		return nil, err
+	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
+
+	if err := compressProduceReq(req, c.conf.Compression); err != nil {
+		spanErrorf(span, err)
+		span.Finish()
+		return nil, err
+	}
+
+	if req.RequiredAcks == proto.RequiredAcksNone {
+		_, err := req.WriteTo(c.conn())
+		spanErrorf(span, err)
+		span.Finish()
+		if err != nil {
+			return nil, err
+		}
+		// No response is ever coming, so the span is finished here and
+		// now: a future returned for RequiredAcksNone carries no respc,
+		// and Wait on it must not depend on ever being called to avoid
+		// leaking the span.
+		return &ProduceFuture{c: c, correlationID: req.CorrelationID}, nil
+	}
+
+	respc, err := c.respWaiter(req.CorrelationID)
+	if err != nil {
+		spanErrorf(span, err)
+		span.Finish()
+		return nil, fmt.Errorf("wait for response: %s", err)
+	}
+
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		c.abortWaiter(req.CorrelationID)
+		spanErrorf(span, err)
+		span.Finish()
+		return nil, err
+	}
+
+	return &ProduceFuture{c: c, correlationID: req.CorrelationID, respc: respc, span: span}, nil
+}
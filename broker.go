@@ -0,0 +1,160 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+
+	"github.com/optiopay/kafka/proto"
+)
+
+// Dialer opens a raw connection to a Kafka node. It mirrors the shape of
+// net.DialTimeout so the default implementation, DefaultDialer, is a thin
+// wrapper around it. Providing a custom Dialer through BrokerConf allows
+// reaching brokers over transports net.DialTimeout cannot express on its
+// own, such as a SOCKS proxy or a service mesh sidecar.
+type Dialer func(network, address string, timeout time.Duration) (net.Conn, error)
+
+// DefaultDialer opens a plain, unencrypted TCP connection.
+func DefaultDialer(network, address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(network, address, timeout)
+}
+
+// SASLAuth carries the credentials used to authenticate a connection with a
+// broker via SASL/PLAIN, right after the transport connection (and, if
+// configured, its TLS handshake) completes.
+type SASLAuth struct {
+	Mechanism string
+	User      string
+	Password  string
+}
+
+// BrokerConf carries the settings applied whenever a new connection to a
+// Kafka node is opened.
+type BrokerConf struct {
+	// Dialer is used to open the raw connection to a node. When nil,
+	// DefaultDialer is used.
+	Dialer Dialer
+
+	// TLSConfig, when set, is used to wrap the dialed connection in a TLS
+	// client before any Kafka request is sent.
+	TLSConfig *tls.Config
+
+	// SASL, when set, is used to authenticate the connection right after
+	// it is established (and, if TLS is configured, after the TLS
+	// handshake completes).
+	SASL *SASLAuth
+
+	// Tracer is used to record a span for every broker RPC. When nil,
+	// opentracing.GlobalTracer() is used.
+	Tracer opentracing.Tracer
+
+	// ReconnectPolicy, when set, makes a connection redial the broker on a
+	// transient error instead of terminally closing.
+	ReconnectPolicy *ReconnectPolicy
+
+	// Compression is the codec used to compress messages sent with
+	// Produce. CompressionNone disables compression.
+	Compression Compression
+}
+
+// WithTracer returns a copy of conf with Tracer set to t.
+func (conf BrokerConf) WithTracer(t opentracing.Tracer) BrokerConf {
+	conf.Tracer = t
+	return conf
+}
+
+// NewBrokerConf returns the default broker configuration.
+func NewBrokerConf() BrokerConf {
+	return BrokerConf{
+		Dialer: DefaultDialer,
+	}
+}
+
+// dialer returns the configured Dialer, falling back to DefaultDialer.
+func (conf BrokerConf) dialer() Dialer {
+	if conf.Dialer != nil {
+		return conf.Dialer
+	}
+	return DefaultDialer
+}
+
+// tracer returns the configured Tracer, falling back to
+// opentracing.GlobalTracer().
+func (conf BrokerConf) tracer() opentracing.Tracer {
+	if conf.Tracer != nil {
+		return conf.Tracer
+	}
+	return opentracing.GlobalTracer()
+}
+
+// Broker represents a single connection to a Kafka node, exposing the
+// context-aware request methods a producer or consumer needs to make a
+// round trip cooperatively cancellable end to end.
+type Broker struct {
+	conn *connection
+}
+
+// Dial connects to the Kafka node at address using conf, returning a Broker
+// ready to serve requests. timeout bounds the dial itself (and the TLS/SASL
+// handshake that follows it). Afterwards it only bounds writing a request
+// whose ctx carries no deadline; it never bounds the wait for a response.
+func Dial(address string, timeout time.Duration, conf BrokerConf) (*Broker, error) {
+	conn, err := newTCPConnection(address, timeout, conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Broker{conn: conn}, nil
+}
+
+// Close closes the underlying connection. Any request in flight fails with
+// ErrClosed.
+func (b *Broker) Close() error {
+	return b.conn.Close()
+}
+
+// Metadata sends req and waits for the response, aborting as soon as ctx is
+// done.
+func (b *Broker) Metadata(ctx context.Context, req *proto.MetadataReq) (*proto.MetadataResp, error) {
+	return b.conn.MetadataCtx(ctx, req)
+}
+
+// Produce sends req and waits for the response, aborting as soon as ctx is
+// done. Sending a request with no ACKs flag returns as soon as the request
+// has been written, without waiting for a response.
+func (b *Broker) Produce(ctx context.Context, req *proto.ProduceReq) (*proto.ProduceResp, error) {
+	return b.conn.ProduceCtx(ctx, req)
+}
+
+// Fetch sends req and waits for the response, aborting as soon as ctx is
+// done.
+func (b *Broker) Fetch(ctx context.Context, req *proto.FetchReq) (*proto.FetchResp, error) {
+	return b.conn.FetchCtx(ctx, req)
+}
+
+// Offset sends req and waits for the response, aborting as soon as ctx is
+// done.
+func (b *Broker) Offset(ctx context.Context, req *proto.OffsetReq) (*proto.OffsetResp, error) {
+	return b.conn.OffsetCtx(ctx, req)
+}
+
+// ConsumerMetadata sends req and waits for the response, aborting as soon as
+// ctx is done.
+func (b *Broker) ConsumerMetadata(ctx context.Context, req *proto.ConsumerMetadataReq) (*proto.ConsumerMetadataResp, error) {
+	return b.conn.ConsumerMetadataCtx(ctx, req)
+}
+
+// OffsetCommit sends req and waits for the response, aborting as soon as
+// ctx is done.
+func (b *Broker) OffsetCommit(ctx context.Context, req *proto.OffsetCommitReq) (*proto.OffsetCommitResp, error) {
+	return b.conn.OffsetCommitCtx(ctx, req)
+}
+
+// OffsetFetch sends req and waits for the response, aborting as soon as ctx
+// is done.
+func (b *Broker) OffsetFetch(ctx context.Context, req *proto.OffsetFetchReq) (*proto.OffsetFetchResp, error) {
+	return b.conn.OffsetFetchCtx(ctx, req)
+}
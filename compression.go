@@ -0,0 +1,209 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+
+	"github.com/optiopay/kafka/proto"
+)
+
+// Compression identifies the codec used to compress a message set, matching
+// the low 3 bits of the Kafka message attributes byte.
+type Compression int8
+
+const (
+	CompressionNone   Compression = 0
+	CompressionGZIP   Compression = 1
+	CompressionSnappy Compression = 2
+
+	// CompressionLZ4 and CompressionZstd name codec ids the Kafka wire
+	// protocol reserves, but this package ships no Compressor for either:
+	// doing so requires a cgo or pure-Go LZ4/Zstd dependency this package
+	// does not otherwise need. Configuring a BrokerConf with one of these
+	// without first calling RegisterCompressor for it fails at connection
+	// time with a clear error, rather than letting a live Produce fail
+	// later with "unsupported compression codec".
+	CompressionLZ4  Compression = 3
+	CompressionZstd Compression = 4
+)
+
+// Compressor compresses and decompresses the raw, wire-encoded bytes of an
+// inner message set carried by a message whose attributes byte names its
+// codec.
+//
+// Decompress is not called anywhere in this package: proto.ReadFetchResp
+// already decompresses a fetch response's inner message sets itself, using
+// whatever codecs the proto package supports directly, with no hook for a
+// Compressor registered here. It remains part of the interface for symmetry
+// with Compress and so a registered Compressor can be exercised directly in
+// tests; a codec registered only through RegisterCompressor does not gain
+// the ability to decode incoming Fetch responses.
+type Compressor interface {
+	Compress(p []byte) ([]byte, error)
+	Decompress(p []byte) ([]byte, error)
+}
+
+var compressors = map[int8]Compressor{
+	int8(CompressionGZIP):   gzipCompressor{},
+	int8(CompressionSnappy): snappyCompressor{},
+}
+
+// RegisterCompressor makes a Compressor available for the given compression
+// attribute id, so that additional codecs (e.g. LZ4, Zstd) can be plugged
+// in by callers without patching the proto package.
+func RegisterCompressor(id int8, c Compressor) {
+	compressors[id] = c
+}
+
+func compressorFor(id int8) (Compressor, error) {
+	c, ok := compressors[id]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression codec: %d", id)
+	}
+	return c, nil
+}
+
+// compressMessages wraps messages into a single message whose Value is the
+// codec-compressed, wire-encoded representation of the original set, with
+// Attributes set to the codec in use. Callers holding no messages or using
+// CompressionNone get the original slice back untouched.
+func compressMessages(messages []proto.Message, codec Compression) ([]proto.Message, error) {
+	if codec == CompressionNone || len(messages) == 0 {
+		return messages, nil
+	}
+
+	compressor, err := compressorFor(int8(codec))
+	if err != nil {
+		return nil, err
+	}
+
+	ms := proto.MessageSet{Messages: messages}
+	var inner bytes.Buffer
+	if _, err := ms.WriteTo(&inner); err != nil {
+		return nil, fmt.Errorf("encode inner message set: %s", err)
+	}
+
+	compressed, err := compressor.Compress(inner.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("compress message set: %s", err)
+	}
+
+	return []proto.Message{{
+		Value:      compressed,
+		Attributes: int8(codec),
+	}}, nil
+}
+
+// compressProduceReq compresses every partition's messages in req using
+// codec, rewriting req.Topics in place. CompressionNone is a no-op.
+func compressProduceReq(req *proto.ProduceReq, codec Compression) error {
+	if codec == CompressionNone {
+		return nil
+	}
+	for ti := range req.Topics {
+		for pi := range req.Topics[ti].Partitions {
+			msgs, err := compressMessages(req.Topics[ti].Partitions[pi].Messages, codec)
+			if err != nil {
+				return err
+			}
+			req.Topics[ti].Partitions[pi].Messages = msgs
+		}
+	}
+	return nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(p []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// snappyMagic is the xerial framing header used by the JVM client: any
+// block stream not starting with it is assumed to be a single, unframed
+// snappy block, as produced by older non-JVM clients.
+var snappyMagic = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0}
+
+const snappyBlockSize = 32 * 1024
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(snappyMagic)
+	if err := binary.Write(&buf, binary.BigEndian, int32(1)); err != nil { // version
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, int32(1)); err != nil { // min compatible version
+		return nil, err
+	}
+
+	for len(p) > 0 {
+		n := snappyBlockSize
+		if n > len(p) {
+			n = len(p)
+		}
+		block := snappy.Encode(nil, p[:n])
+		if err := binary.Write(&buf, binary.BigEndian, int32(len(block))); err != nil {
+			return nil, err
+		}
+		buf.Write(block)
+		p = p[n:]
+	}
+	return buf.Bytes(), nil
+}
+
+func (snappyCompressor) Decompress(p []byte) ([]byte, error) {
+	if len(p) < len(snappyMagic) || !bytes.Equal(p[:len(snappyMagic)], snappyMagic) {
+		return snappy.Decode(nil, p)
+	}
+
+	r := bytes.NewReader(p[len(snappyMagic):])
+	var version, compat int32
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &compat); err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for r.Len() > 0 {
+		var blockLen int32
+		if err := binary.Read(r, binary.BigEndian, &blockLen); err != nil {
+			return nil, err
+		}
+		block := make([]byte, blockLen)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, err
+		}
+		dec, err := snappy.Decode(nil, block)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, dec...)
+	}
+	return out, nil
+}
@@ -0,0 +1,69 @@
+package kafka
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestGzipCompressorRoundTrip(t *testing.T) {
+	c := gzipCompressor{}
+	want := []byte("the quick brown fox jumps over the lazy dog")
+
+	compressed, err := c.Compress(want)
+	if err != nil {
+		t.Fatalf("Compress: %s", err)
+	}
+	got, err := c.Decompress(compressed)
+	if err != nil {
+		t.Fatalf("Decompress: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSnappyCompressorXerialRoundTrip(t *testing.T) {
+	c := snappyCompressor{}
+	want := bytes.Repeat([]byte("payload-"), 8*1024) // spans several blocks
+
+	compressed, err := c.Compress(want)
+	if err != nil {
+		t.Fatalf("Compress: %s", err)
+	}
+	if !bytes.HasPrefix(compressed, snappyMagic) {
+		t.Fatalf("Compress did not frame output with the xerial magic")
+	}
+	got, err := c.Decompress(compressed)
+	if err != nil {
+		t.Fatalf("Decompress: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %d bytes, want %d bytes", len(got), len(want))
+	}
+}
+
+func TestSnappyCompressorUnframedFallback(t *testing.T) {
+	c := snappyCompressor{}
+	want := []byte("written by a client that does not use xerial framing")
+
+	unframed := snappy.Encode(nil, want)
+	if bytes.HasPrefix(unframed, snappyMagic) {
+		t.Fatalf("test fixture unexpectedly collides with the xerial magic")
+	}
+
+	got, err := c.Decompress(unframed)
+	if err != nil {
+		t.Fatalf("Decompress: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestCompressorForUnregisteredCodec(t *testing.T) {
+	if _, err := compressorFor(int8(CompressionLZ4)); err == nil {
+		t.Fatal("expected an error for an unregistered codec, got nil")
+	}
+}
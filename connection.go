@@ -3,6 +3,9 @@ package kafka
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -12,40 +15,158 @@ import (
 	"sync"
 	"time"
 
+	opentracing "github.com/opentracing/opentracing-go"
+
 	"github.com/optiopay/kafka/proto"
 )
 
 // ErrClosed is returned as result of any request made using closed connection.
 var ErrClosed = errors.New("closed")
 
+// ErrReconnecting is returned to every request still waiting for a response
+// when a connection with a ReconnectPolicy loses its socket to a transient
+// error and starts redialing the broker. A request sent while the redial is
+// in progress fails with the error of writing to the closed socket instead.
+// Unlike ErrClosed, the connection remains usable: a caller may simply
+// retry once the redial completes.
+var ErrReconnecting = errors.New("reconnecting")
+
+// result is what a response waiter receives: either the raw response bytes
+// for its correlation ID, or the error that unblocked it instead (the
+// connection closed or is mid-reconnect). Exactly one is ever set.
+type result struct {
+	body []byte
+	err  error
+}
+
 // Low level abstraction over connection to Kafka.
 type connection struct {
-	rw     io.ReadWriteCloser
+	address string
+	timeout time.Duration
+	conf    BrokerConf
+
 	stop   chan struct{}
 	nextID chan int32
+	tracer opentracing.Tracer
 
 	mu      sync.Mutex
-	respc   map[int32]chan []byte
+	rw      io.ReadWriteCloser
+	rd      *bufio.Reader
+	respc   map[int32]chan result
+	closed  bool
 	stopErr error
 }
 
 // newConnection returns new, initialized connection or error
-func newTCPConnection(address string, timeout time.Duration) (*connection, error) {
-	conn, err := net.DialTimeout("tcp", address, timeout)
+func newTCPConnection(address string, timeout time.Duration, conf BrokerConf) (*connection, error) {
+	if conf.Compression != CompressionNone {
+		if _, err := compressorFor(int8(conf.Compression)); err != nil {
+			return nil, fmt.Errorf("broker conf: %s", err)
+		}
+	}
+
+	rw, rd, err := dialConnection(address, timeout, conf)
 	if err != nil {
 		return nil, err
 	}
+
 	c := &connection{
-		stop:   make(chan struct{}),
-		nextID: make(chan int32),
-		rw:     conn,
-		respc:  make(map[int32]chan []byte),
+		address: address,
+		timeout: timeout,
+		conf:    conf,
+		stop:    make(chan struct{}),
+		nextID:  make(chan int32),
+		rw:      rw,
+		rd:      rd,
+		tracer:  conf.tracer(),
+		respc:   make(map[int32]chan result),
 	}
 	go c.nextIDLoop()
 	go c.readRespLoop()
 	return c, nil
 }
 
+// dialConnection opens a raw connection to address using conf's Dialer,
+// wraps it in TLS when configured and performs the SASL handshake when
+// configured, returning the resulting transport together with the buffered
+// reader used to consume it. A positive timeout bounds the dial and both
+// handshakes; the deadline is cleared before returning.
+func dialConnection(address string, timeout time.Duration, conf BrokerConf) (io.ReadWriteCloser, *bufio.Reader, error) {
+	conn, err := conf.dialer()("tcp", address, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	var rw io.ReadWriteCloser = conn
+	if conf.TLSConfig != nil {
+		tconn := tls.Client(conn, conf.TLSConfig)
+		if err := tconn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, nil, fmt.Errorf("tls handshake: %s", err)
+		}
+		rw = tconn
+	}
+
+	rd := bufio.NewReader(rw)
+
+	if conf.SASL != nil {
+		if err := saslAuthenticate(rw, rd, conf.SASL); err != nil {
+			_ = rw.Close()
+			return nil, nil, err
+		}
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return rw, rd, nil
+}
+
+// saslAuthenticate performs a SASL/PLAIN handshake over rw, consuming the
+// response through rd. It must complete before readRespLoop starts reading
+// from rd, otherwise the auth bytes could be mistaken for a response to an
+// unrelated correlation ID.
+//
+// This predates the SaslHandshake/SaslAuthenticate Kafka APIs (api keys 17
+// and 36): those carry a proto.RequestHeader and need proto support this
+// package's proto fork does not have. Brokers that still accept the
+// original, header-less SASL/PLAIN exchange (a bare size-prefixed token,
+// immediately after the TCP/TLS handshake) can be reached without it: the
+// token is the RFC 4616 message authzid \0 authcid \0 passwd, with authzid
+// left empty since this client has no separate authorization identity.
+// Only PLAIN is implemented; anything else is rejected up front rather
+// than silently sent as if it were PLAIN.
+func saslAuthenticate(rw io.ReadWriter, rd *bufio.Reader, auth *SASLAuth) error {
+	if auth.Mechanism != "" && auth.Mechanism != "PLAIN" {
+		return fmt.Errorf("sasl: unsupported mechanism %q (only PLAIN is implemented)", auth.Mechanism)
+	}
+
+	token := []byte("\x00" + auth.User + "\x00" + auth.Password)
+	if err := binary.Write(rw, binary.BigEndian, int32(len(token))); err != nil {
+		return fmt.Errorf("sasl authenticate: %s", err)
+	}
+	if _, err := rw.Write(token); err != nil {
+		return fmt.Errorf("sasl authenticate: %s", err)
+	}
+
+	var size int32
+	if err := binary.Read(rd, binary.BigEndian, &size); err != nil {
+		return fmt.Errorf("sasl authenticate: reading response: %s", err)
+	}
+	if size < 0 {
+		return fmt.Errorf("sasl authenticate: invalid response size %d", size)
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(rd, resp); err != nil {
+		return fmt.Errorf("sasl authenticate: reading response: %s", err)
+	}
+	if len(resp) > 0 {
+		return fmt.Errorf("sasl authenticate failed: %s", resp)
+	}
+	return nil
+}
+
 // nextIDLoop generates correlation IDs, making sure they are always in order
 // and within the scope of request-response mapping array.
 func (c *connection) nextIDLoop() {
@@ -67,19 +188,20 @@ func (c *connection) nextIDLoop() {
 // readRespLoop constantly reading response messages from the socket and after
 // partial parsing, sends byte representation of the whole message to request
 // sending process.
+//
+// When the connection has a ReconnectPolicy and the read fails with a
+// transient error, the loop does not terminate: it hands off to reconnect,
+// which redials the broker and, once healthy, lets this same loop resume
+// reading from the new socket.
 func (c *connection) readRespLoop() {
-	defer func() {
-		c.mu.Lock()
-		for _, cc := range c.respc {
-			close(cc)
-		}
-		c.mu.Unlock()
-	}()
-
-	rd := bufio.NewReader(c.rw)
 	for {
-		correlationID, b, err := proto.ReadResp(rd)
+		correlationID, b, err := proto.ReadResp(c.reader())
 		if err != nil {
+			if c.conf.ReconnectPolicy != nil && isTransientErr(err) {
+				if rerr := c.reconnect(err); rerr == nil {
+					continue
+				}
+			}
 			_ = c.closeConnection(err)
 			return
 		}
@@ -93,7 +215,7 @@ func (c *connection) readRespLoop() {
 			continue
 		}
 
-		rc <- b
+		rc <- result{body: b}
 		close(rc)
 	}
 }
@@ -103,67 +225,222 @@ func (c *connection) readRespLoop() {
 // will arrive.
 // After pushing response message, channel is closed.
 //
+// The channel is buffered by exactly one: readRespLoop and drainWaiters,
+// the only senders, must never block on a delivery. A
+// caller can always abandon its waiter -- a ctx that is done the instant a
+// response lands, or an async future nobody ever Waits on -- and the
+// buffer guarantees the send still completes immediately, so one abandoned
+// request can never wedge every other request on the connection.
+//
 // Upon connection close, all unconsumed channels are closed.
-func (c *connection) respWaiter(correlationID int32) (respc chan []byte, err error) {
+func (c *connection) respWaiter(correlationID int32) (respc chan result, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if _, ok := c.respc[correlationID]; ok {
 		return nil, fmt.Errorf("correlation conflict: %d", correlationID)
 	}
-	respc = make(chan []byte)
+	respc = make(chan result, 1)
 	c.respc[correlationID] = respc
 	return respc, nil
 }
 
-func (c *connection) closeConnection(err error) error {
+// conn returns the current underlying transport. Guarded by the mutex so
+// that a concurrent reconnect swapping the socket is never observed half
+// written.
+func (c *connection) conn() io.ReadWriteCloser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rw
+}
+
+// reader returns the current buffered reader. Only readRespLoop calls this,
+// and readRespLoop itself is the one goroutine that ever swaps it (via
+// reconnect), so this is for consistency with conn rather than to guard
+// against another reader.
+func (c *connection) reader() *bufio.Reader {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.rd
+}
+
+// getStopErr returns the error a permanently closed connection was closed
+// with, or nil if it is still open (including while reconnecting).
+func (c *connection) getStopErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopErr
+}
+
+// drainWaiters hands err to every currently registered response waiter and
+// empties the table, so that neither a permanent close nor a reconnect
+// leaves a goroutine blocked on <-respc forever.
+func (c *connection) drainWaiters(err error) {
+	c.mu.Lock()
+	waiters := c.respc
+	c.respc = make(map[int32]chan result)
+	c.mu.Unlock()
 
-	if c.stopErr != nil {
-		return c.stopErr
+	for _, rc := range waiters {
+		rc <- result{err: err}
+		close(rc)
 	}
+}
 
+// closeConnection terminally closes the connection with err, interrupting
+// any in-progress reconnect. It is idempotent: once closed, it keeps
+// returning the error the first call closed with.
+func (c *connection) closeConnection(err error) error {
+	c.mu.Lock()
+	if c.closed {
+		stopErr := c.stopErr
+		c.mu.Unlock()
+		return stopErr
+	}
+	c.closed = true
 	c.stopErr = err
+	rw := c.rw
+	c.mu.Unlock()
+
+	c.drainWaiters(err)
 
 	c.stop <- struct{}{}
 	close(c.stop)
 
-	return c.rw.Close()
+	return rw.Close()
 }
 
 func (c *connection) Close() error {
 	return c.closeConnection(ErrClosed)
 }
 
+// abortWaiter removes the response channel registered for correlationID
+// without touching the underlying socket, so that a caller giving up on a
+// single request does not affect any other in-flight request on the same
+// connection.
+func (c *connection) abortWaiter(correlationID int32) {
+	c.mu.Lock()
+	delete(c.respc, correlationID)
+	c.mu.Unlock()
+}
+
+// setWriteDeadline derives a write deadline from the context, if it has
+// one, and applies it to the underlying connection when possible. A ctx
+// with no deadline falls back to one bounded by c.timeout instead of no
+// deadline at all: net.Conn has no way to interrupt a write via ctx.Done(),
+// only via SetWriteDeadline, so a cancellable-but-deadlineless ctx would
+// otherwise leave a stuck write uncancellable for as long as the socket
+// stays wedged. Callers still defer clearWriteDeadline so this deadline
+// never leaks into a later, unrelated write on this long-lived connection.
+// Connections that do not implement net.Conn (e.g. in tests) are left
+// untouched.
+func (c *connection) setWriteDeadline(ctx context.Context) error {
+	cn, ok := c.conn().(net.Conn)
+	if !ok {
+		return nil
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.timeout)
+	}
+	return cn.SetWriteDeadline(deadline)
+}
+
+// clearWriteDeadline removes any deadline set by setWriteDeadline for the
+// call that just finished, so that it cannot cause a later, unrelated
+// write on this long-lived connection to fail with a spurious timeout.
+func (c *connection) clearWriteDeadline() {
+	if cn, ok := c.conn().(net.Conn); ok {
+		_ = cn.SetWriteDeadline(time.Time{})
+	}
+}
+
 // Metadata sends given metadata request to kafka node and returns related
 // metadata response.
 // Calling this method on closed connection will always return ErrClosed.
 func (c *connection) Metadata(req *proto.MetadataReq) (*proto.MetadataResp, error) {
+	span := c.startSpan(context.Background(), "Metadata")
+	defer span.Finish()
+
 	var ok bool
 	if req.CorrelationID, ok = <-c.nextID; !ok {
-		c.mu.Lock()
-		err := c.stopErr
-		c.mu.Unlock()
+		err := c.getStopErr()
+		spanErrorf(span, err)
 		return nil, err
 	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
 
 	respc, err := c.respWaiter(req.CorrelationID)
 	if err != nil {
+		spanErrorf(span, err)
 		return nil, fmt.Errorf("wait for response: %s", err)
 	}
 
-	if _, err := req.WriteTo(c.rw); err != nil {
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
 		return nil, err
 	}
-	b, ok := <-respc
-	if !ok {
-		c.mu.Lock()
-		err := c.stopErr
-		c.mu.Unlock()
+	res := <-respc
+	if res.err != nil {
+		spanErrorf(span, res.err)
+		return nil, res.err
+	}
+	resp, err := proto.ReadMetadataResp(bytes.NewReader(res.body))
+	spanErrorf(span, err)
+	return resp, err
+}
+
+// MetadataCtx works like Metadata, but aborts the wait as soon as ctx is
+// done, returning ctx.Err() without closing the underlying connection so
+// that other in-flight requests survive.
+func (c *connection) MetadataCtx(ctx context.Context, req *proto.MetadataReq) (*proto.MetadataResp, error) {
+	span := c.startSpan(ctx, "Metadata")
+	defer span.Finish()
+	defer c.clearWriteDeadline()
+
+	var ok bool
+	select {
+	case req.CorrelationID, ok = <-c.nextID:
+		if !ok {
+			err := c.getStopErr()
+			spanErrorf(span, err)
+			return nil, err
+		}
+	case <-ctx.Done():
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
+	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
+
+	respc, err := c.respWaiter(req.CorrelationID)
+	if err != nil {
+		spanErrorf(span, err)
+		return nil, fmt.Errorf("wait for response: %s", err)
+	}
+
+	if err := c.setWriteDeadline(ctx); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
 		return nil, err
 	}
-	return proto.ReadMetadataResp(bytes.NewReader(b))
+
+	select {
+	case res := <-respc:
+		if res.err != nil {
+			spanErrorf(span, res.err)
+			return nil, res.err
+		}
+		resp, err := proto.ReadMetadataResp(bytes.NewReader(res.body))
+		spanErrorf(span, err)
+		return resp, err
+	case <-ctx.Done():
+		c.abortWaiter(req.CorrelationID)
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
+	}
 }
 
 // Produce sends given produce request to kafka node and returns related
@@ -171,133 +448,544 @@ func (c *connection) Metadata(req *proto.MetadataReq) (*proto.MetadataResp, erro
 // right after sending request, without waiting for response.
 // Calling this method on closed connection will always return ErrClosed.
 func (c *connection) Produce(req *proto.ProduceReq) (*proto.ProduceResp, error) {
+	span := c.startSpan(context.Background(), "Produce")
+	span.SetTag("kafka.required_acks", req.RequiredAcks)
+	tagTopicPartitions(span, produceTopicPartitions(req.Topics))
+	defer span.Finish()
+
 	var ok bool
 	if req.CorrelationID, ok = <-c.nextID; !ok {
-		return nil, c.stopErr
+		err := c.getStopErr()
+		spanErrorf(span, err)
+		return nil, err
+	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
+
+	if err := compressProduceReq(req, c.conf.Compression); err != nil {
+		spanErrorf(span, err)
+		return nil, err
 	}
 
 	if req.RequiredAcks == proto.RequiredAcksNone {
-		_, err := req.WriteTo(c.rw)
+		_, err := req.WriteTo(c.conn())
+		spanErrorf(span, err)
 		return nil, err
 	}
 
 	respc, err := c.respWaiter(req.CorrelationID)
 	if err != nil {
+		spanErrorf(span, err)
 		return nil, fmt.Errorf("wait for response: %s", err)
 	}
 
-	if _, err := req.WriteTo(c.rw); err != nil {
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
 		return nil, err
 	}
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
+	res := <-respc
+	if res.err != nil {
+		spanErrorf(span, res.err)
+		return nil, res.err
+	}
+	resp, err := proto.ReadProduceResp(bytes.NewReader(res.body))
+	spanErrorf(span, err)
+	return resp, err
+}
+
+// ProduceCtx works like Produce, but aborts the wait as soon as ctx is done,
+// returning ctx.Err() without closing the underlying connection so that
+// other in-flight requests survive.
+func (c *connection) ProduceCtx(ctx context.Context, req *proto.ProduceReq) (*proto.ProduceResp, error) {
+	span := c.startSpan(ctx, "Produce")
+	span.SetTag("kafka.required_acks", req.RequiredAcks)
+	tagTopicPartitions(span, produceTopicPartitions(req.Topics))
+	defer span.Finish()
+	defer c.clearWriteDeadline()
+
+	var ok bool
+	select {
+	case req.CorrelationID, ok = <-c.nextID:
+		if !ok {
+			err := c.getStopErr()
+			spanErrorf(span, err)
+			return nil, err
+		}
+	case <-ctx.Done():
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
+	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
+
+	if err := compressProduceReq(req, c.conf.Compression); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+
+	if req.RequiredAcks == proto.RequiredAcksNone {
+		if err := c.setWriteDeadline(ctx); err != nil {
+			spanErrorf(span, err)
+			return nil, err
+		}
+		_, err := req.WriteTo(c.conn())
+		spanErrorf(span, err)
+		return nil, err
+	}
+
+	respc, err := c.respWaiter(req.CorrelationID)
+	if err != nil {
+		spanErrorf(span, err)
+		return nil, fmt.Errorf("wait for response: %s", err)
+	}
+
+	if err := c.setWriteDeadline(ctx); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+
+	select {
+	case res := <-respc:
+		if res.err != nil {
+			spanErrorf(span, res.err)
+			return nil, res.err
+		}
+		resp, err := proto.ReadProduceResp(bytes.NewReader(res.body))
+		spanErrorf(span, err)
+		return resp, err
+	case <-ctx.Done():
+		c.abortWaiter(req.CorrelationID)
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
 	}
-	return proto.ReadProduceResp(bytes.NewReader(b))
 }
 
 // Fetch sends given fetch request to kafka node and returns related response.
 // Calling this method on closed connection will always return ErrClosed.
 func (c *connection) Fetch(req *proto.FetchReq) (*proto.FetchResp, error) {
+	span := c.startSpan(context.Background(), "Fetch")
+	tagTopicPartitions(span, fetchTopicPartitions(req.Topics))
+	defer span.Finish()
+
 	var ok bool
 	if req.CorrelationID, ok = <-c.nextID; !ok {
-		return nil, c.stopErr
+		err := c.getStopErr()
+		spanErrorf(span, err)
+		return nil, err
 	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
 
 	respc, err := c.respWaiter(req.CorrelationID)
 	if err != nil {
+		spanErrorf(span, err)
 		return nil, fmt.Errorf("wait for response: %s", err)
 	}
 
-	if _, err := req.WriteTo(c.rw); err != nil {
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
 		return nil, err
 	}
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
+	res := <-respc
+	if res.err != nil {
+		spanErrorf(span, res.err)
+		return nil, res.err
+	}
+	resp, err := proto.ReadFetchResp(bytes.NewReader(res.body))
+	spanErrorf(span, err)
+	return resp, err
+}
+
+// FetchCtx works like Fetch, but aborts the wait as soon as ctx is done,
+// returning ctx.Err() without closing the underlying connection so that
+// other in-flight requests survive.
+func (c *connection) FetchCtx(ctx context.Context, req *proto.FetchReq) (*proto.FetchResp, error) {
+	span := c.startSpan(ctx, "Fetch")
+	tagTopicPartitions(span, fetchTopicPartitions(req.Topics))
+	defer span.Finish()
+	defer c.clearWriteDeadline()
+
+	var ok bool
+	select {
+	case req.CorrelationID, ok = <-c.nextID:
+		if !ok {
+			err := c.getStopErr()
+			spanErrorf(span, err)
+			return nil, err
+		}
+	case <-ctx.Done():
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
+	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
+
+	respc, err := c.respWaiter(req.CorrelationID)
+	if err != nil {
+		spanErrorf(span, err)
+		return nil, fmt.Errorf("wait for response: %s", err)
+	}
+
+	if err := c.setWriteDeadline(ctx); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+
+	select {
+	case res := <-respc:
+		if res.err != nil {
+			spanErrorf(span, res.err)
+			return nil, res.err
+		}
+		resp, err := proto.ReadFetchResp(bytes.NewReader(res.body))
+		spanErrorf(span, err)
+		return resp, err
+	case <-ctx.Done():
+		c.abortWaiter(req.CorrelationID)
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
 	}
-	return proto.ReadFetchResp(bytes.NewReader(b))
 }
 
 // Offset sends given offset request to kafka node and returns related response.
 // Calling this method on closed connection will always return ErrClosed.
 func (c *connection) Offset(req *proto.OffsetReq) (*proto.OffsetResp, error) {
+	span := c.startSpan(context.Background(), "Offset")
+	tagTopicPartitions(span, offsetTopicPartitions(req.Topics))
+	defer span.Finish()
+
 	var ok bool
 	if req.CorrelationID, ok = <-c.nextID; !ok {
-		return nil, c.stopErr
+		err := c.getStopErr()
+		spanErrorf(span, err)
+		return nil, err
 	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
 
 	respc, err := c.respWaiter(req.CorrelationID)
 	if err != nil {
+		spanErrorf(span, err)
 		return nil, fmt.Errorf("wait for response: %s", err)
 	}
 
 	// TODO(husio) documentation is not mentioning this directly, but I assume
 	// -1 is for non node clients
 	req.ReplicaID = -1
-	if _, err := req.WriteTo(c.rw); err != nil {
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
 		return nil, err
 	}
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
+	res := <-respc
+	if res.err != nil {
+		spanErrorf(span, res.err)
+		return nil, res.err
+	}
+	resp, err := proto.ReadOffsetResp(bytes.NewReader(res.body))
+	spanErrorf(span, err)
+	return resp, err
+}
+
+// OffsetCtx works like Offset, but aborts the wait as soon as ctx is done,
+// returning ctx.Err() without closing the underlying connection so that
+// other in-flight requests survive.
+func (c *connection) OffsetCtx(ctx context.Context, req *proto.OffsetReq) (*proto.OffsetResp, error) {
+	span := c.startSpan(ctx, "Offset")
+	tagTopicPartitions(span, offsetTopicPartitions(req.Topics))
+	defer span.Finish()
+	defer c.clearWriteDeadline()
+
+	var ok bool
+	select {
+	case req.CorrelationID, ok = <-c.nextID:
+		if !ok {
+			err := c.getStopErr()
+			spanErrorf(span, err)
+			return nil, err
+		}
+	case <-ctx.Done():
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
+	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
+
+	respc, err := c.respWaiter(req.CorrelationID)
+	if err != nil {
+		spanErrorf(span, err)
+		return nil, fmt.Errorf("wait for response: %s", err)
+	}
+
+	// TODO(husio) documentation is not mentioning this directly, but I assume
+	// -1 is for non node clients
+	req.ReplicaID = -1
+	if err := c.setWriteDeadline(ctx); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+
+	select {
+	case res := <-respc:
+		if res.err != nil {
+			spanErrorf(span, res.err)
+			return nil, res.err
+		}
+		resp, err := proto.ReadOffsetResp(bytes.NewReader(res.body))
+		spanErrorf(span, err)
+		return resp, err
+	case <-ctx.Done():
+		c.abortWaiter(req.CorrelationID)
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
 	}
-	return proto.ReadOffsetResp(bytes.NewReader(b))
 }
 
 func (c *connection) ConsumerMetadata(req *proto.ConsumerMetadataReq) (*proto.ConsumerMetadataResp, error) {
+	span := c.startSpan(context.Background(), "ConsumerMetadata")
+	defer span.Finish()
+
 	var ok bool
 	if req.CorrelationID, ok = <-c.nextID; !ok {
-		return nil, c.stopErr
+		err := c.getStopErr()
+		spanErrorf(span, err)
+		return nil, err
 	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
 	respc, err := c.respWaiter(req.CorrelationID)
 	if err != nil {
+		spanErrorf(span, err)
 		return nil, fmt.Errorf("wait for response: %s", err)
 	}
-	if _, err := req.WriteTo(c.rw); err != nil {
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
 		return nil, err
 	}
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
+	res := <-respc
+	if res.err != nil {
+		spanErrorf(span, res.err)
+		return nil, res.err
+	}
+	resp, err := proto.ReadConsumerMetadataResp(bytes.NewReader(res.body))
+	spanErrorf(span, err)
+	return resp, err
+}
+
+// ConsumerMetadataCtx works like ConsumerMetadata, but aborts the wait as
+// soon as ctx is done, returning ctx.Err() without closing the underlying
+// connection so that other in-flight requests survive.
+func (c *connection) ConsumerMetadataCtx(ctx context.Context, req *proto.ConsumerMetadataReq) (*proto.ConsumerMetadataResp, error) {
+	span := c.startSpan(ctx, "ConsumerMetadata")
+	defer span.Finish()
+	defer c.clearWriteDeadline()
+
+	var ok bool
+	select {
+	case req.CorrelationID, ok = <-c.nextID:
+		if !ok {
+			err := c.getStopErr()
+			spanErrorf(span, err)
+			return nil, err
+		}
+	case <-ctx.Done():
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
+	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
+	respc, err := c.respWaiter(req.CorrelationID)
+	if err != nil {
+		spanErrorf(span, err)
+		return nil, fmt.Errorf("wait for response: %s", err)
+	}
+	if err := c.setWriteDeadline(ctx); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+	select {
+	case res := <-respc:
+		if res.err != nil {
+			spanErrorf(span, res.err)
+			return nil, res.err
+		}
+		resp, err := proto.ReadConsumerMetadataResp(bytes.NewReader(res.body))
+		spanErrorf(span, err)
+		return resp, err
+	case <-ctx.Done():
+		c.abortWaiter(req.CorrelationID)
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
 	}
-	return proto.ReadConsumerMetadataResp(bytes.NewReader(b))
 }
 
 func (c *connection) OffsetCommit(req *proto.OffsetCommitReq) (*proto.OffsetCommitResp, error) {
+	span := c.startSpan(context.Background(), "OffsetCommit")
+	tagTopicPartitions(span, offsetCommitTopicPartitions(req.Topics))
+	defer span.Finish()
+
 	var ok bool
 	if req.CorrelationID, ok = <-c.nextID; !ok {
-		return nil, c.stopErr
+		err := c.getStopErr()
+		spanErrorf(span, err)
+		return nil, err
 	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
 	respc, err := c.respWaiter(req.CorrelationID)
 	if err != nil {
+		spanErrorf(span, err)
 		return nil, fmt.Errorf("wait for response: %s", err)
 	}
-	if _, err := req.WriteTo(c.rw); err != nil {
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
 		return nil, err
 	}
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
+	res := <-respc
+	if res.err != nil {
+		spanErrorf(span, res.err)
+		return nil, res.err
+	}
+	resp, err := proto.ReadOffsetCommitResp(bytes.NewReader(res.body))
+	spanErrorf(span, err)
+	return resp, err
+}
+
+// OffsetCommitCtx works like OffsetCommit, but aborts the wait as soon as
+// ctx is done, returning ctx.Err() without closing the underlying
+// connection so that other in-flight requests survive.
+func (c *connection) OffsetCommitCtx(ctx context.Context, req *proto.OffsetCommitReq) (*proto.OffsetCommitResp, error) {
+	span := c.startSpan(ctx, "OffsetCommit")
+	tagTopicPartitions(span, offsetCommitTopicPartitions(req.Topics))
+	defer span.Finish()
+	defer c.clearWriteDeadline()
+
+	var ok bool
+	select {
+	case req.CorrelationID, ok = <-c.nextID:
+		if !ok {
+			err := c.getStopErr()
+			spanErrorf(span, err)
+			return nil, err
+		}
+	case <-ctx.Done():
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
+	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
+	respc, err := c.respWaiter(req.CorrelationID)
+	if err != nil {
+		spanErrorf(span, err)
+		return nil, fmt.Errorf("wait for response: %s", err)
+	}
+	if err := c.setWriteDeadline(ctx); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+	select {
+	case res := <-respc:
+		if res.err != nil {
+			spanErrorf(span, res.err)
+			return nil, res.err
+		}
+		resp, err := proto.ReadOffsetCommitResp(bytes.NewReader(res.body))
+		spanErrorf(span, err)
+		return resp, err
+	case <-ctx.Done():
+		c.abortWaiter(req.CorrelationID)
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
 	}
-	return proto.ReadOffsetCommitResp(bytes.NewReader(b))
 }
 
 func (c *connection) OffsetFetch(req *proto.OffsetFetchReq) (*proto.OffsetFetchResp, error) {
+	span := c.startSpan(context.Background(), "OffsetFetch")
+	tagTopicPartitions(span, offsetFetchTopicPartitions(req.Topics))
+	defer span.Finish()
+
 	var ok bool
 	if req.CorrelationID, ok = <-c.nextID; !ok {
-		return nil, c.stopErr
+		err := c.getStopErr()
+		spanErrorf(span, err)
+		return nil, err
 	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
 	respc, err := c.respWaiter(req.CorrelationID)
 	if err != nil {
+		spanErrorf(span, err)
 		return nil, fmt.Errorf("wait for response: %s", err)
 	}
-	if _, err := req.WriteTo(c.rw); err != nil {
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
 		return nil, err
 	}
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
+	res := <-respc
+	if res.err != nil {
+		spanErrorf(span, res.err)
+		return nil, res.err
+	}
+	resp, err := proto.ReadOffsetFetchResp(bytes.NewReader(res.body))
+	spanErrorf(span, err)
+	return resp, err
+}
+
+// OffsetFetchCtx works like OffsetFetch, but aborts the wait as soon as ctx
+// is done, returning ctx.Err() without closing the underlying connection so
+// that other in-flight requests survive.
+func (c *connection) OffsetFetchCtx(ctx context.Context, req *proto.OffsetFetchReq) (*proto.OffsetFetchResp, error) {
+	span := c.startSpan(ctx, "OffsetFetch")
+	tagTopicPartitions(span, offsetFetchTopicPartitions(req.Topics))
+	defer span.Finish()
+	defer c.clearWriteDeadline()
+
+	var ok bool
+	select {
+	case req.CorrelationID, ok = <-c.nextID:
+		if !ok {
+			err := c.getStopErr()
+			spanErrorf(span, err)
+			return nil, err
+		}
+	case <-ctx.Done():
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
+	}
+	span.SetTag("kafka.correlation_id", req.CorrelationID)
+	respc, err := c.respWaiter(req.CorrelationID)
+	if err != nil {
+		spanErrorf(span, err)
+		return nil, fmt.Errorf("wait for response: %s", err)
+	}
+	if err := c.setWriteDeadline(ctx); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+	if _, err := req.WriteTo(c.conn()); err != nil {
+		spanErrorf(span, err)
+		return nil, err
+	}
+	select {
+	case res := <-respc:
+		if res.err != nil {
+			spanErrorf(span, res.err)
+			return nil, res.err
+		}
+		resp, err := proto.ReadOffsetFetchResp(bytes.NewReader(res.body))
+		spanErrorf(span, err)
+		return resp, err
+	case <-ctx.Done():
+		c.abortWaiter(req.CorrelationID)
+		spanErrorf(span, ctx.Err())
+		return nil, ctx.Err()
 	}
-	return proto.ReadOffsetFetchResp(bytes.NewReader(b))
 }
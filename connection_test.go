@@ -0,0 +1,182 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestConnection builds a connection without dialing anything, for tests
+// that only exercise the respc/stop bookkeeping.
+func newTestConnection() *connection {
+	return &connection{
+		stop:  make(chan struct{}),
+		respc: make(map[int32]chan result),
+	}
+}
+
+func TestAbortWaiterRemovesOnlyItsOwnEntry(t *testing.T) {
+	c := newTestConnection()
+
+	kept, err := c.respWaiter(1)
+	if err != nil {
+		t.Fatalf("respWaiter(1): %s", err)
+	}
+	if _, err := c.respWaiter(2); err != nil {
+		t.Fatalf("respWaiter(2): %s", err)
+	}
+
+	c.abortWaiter(2)
+
+	c.mu.Lock()
+	_, stillThere := c.respc[1]
+	_, aborted := c.respc[2]
+	c.mu.Unlock()
+
+	if !stillThere {
+		t.Fatal("abortWaiter(2) removed an unrelated waiter")
+	}
+	if aborted {
+		t.Fatal("abortWaiter(2) did not remove its own waiter")
+	}
+
+	// Aborting correlation ID 2 leaves the unrelated waiter for 1 alone:
+	// its channel is neither sent to nor closed.
+	select {
+	case <-kept:
+		t.Fatal("unrelated waiter's channel was unexpectedly closed")
+	default:
+	}
+}
+
+func TestDrainWaitersDeliversErrToEveryWaiter(t *testing.T) {
+	c := newTestConnection()
+
+	respc1, _ := c.respWaiter(1)
+	respc2, _ := c.respWaiter(2)
+
+	wantErr := errors.New("boom")
+	// Called directly, not backgrounded: drainWaiters must not block on
+	// waiters nobody is draining concurrently, now that respWaiter's
+	// channel is buffered. Backgrounding this call would hide exactly the
+	// deadlock it's meant to catch.
+	c.drainWaiters(wantErr)
+
+	for i, respc := range []chan result{respc1, respc2} {
+		res, ok := <-respc
+		if !ok {
+			t.Fatalf("waiter %d: channel closed with no value", i)
+		}
+		if res.err != wantErr {
+			t.Fatalf("waiter %d: err = %v, want %v", i, res.err, wantErr)
+		}
+		if _, ok := <-respc; ok {
+			t.Fatalf("waiter %d: channel not closed after delivering result", i)
+		}
+	}
+
+	c.mu.Lock()
+	n := len(c.respc)
+	c.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("respc table has %d entries after drain, want 0", n)
+	}
+}
+
+// TestCtxDoneRacingDeliveryDoesNotWedgeReader reproduces the race a *Ctx
+// method's select races against: a response can land on respc the instant
+// ctx is done, so readRespLoop has already looked up and deleted the
+// waiter's map entry by the time the caller's ctx.Done() case is chosen.
+// abortWaiter is then a no-op (the entry is already gone), and with an
+// unbuffered channel readRespLoop would block forever on a send nobody
+// ever receives -- wedging every other request on the connection. The
+// cap-1 buffer on respc means the send in readRespLoop's place below
+// always completes, so the single reader goroutine is never at the mercy
+// of whether the caller happens to still be listening.
+func TestCtxDoneRacingDeliveryDoesNotWedgeReader(t *testing.T) {
+	c := newTestConnection()
+
+	respc, err := c.respWaiter(1)
+	if err != nil {
+		t.Fatalf("respWaiter(1): %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Simulate readRespLoop: look up and remove the waiter, then deliver,
+	// exactly as it does for a real response arriving on the wire.
+	c.mu.Lock()
+	rc, ok := c.respc[1]
+	delete(c.respc, 1)
+	c.mu.Unlock()
+	if !ok {
+		t.Fatal("waiter for correlation 1 vanished before delivery")
+	}
+	rc <- result{body: []byte("late response")}
+	close(rc)
+
+	// The caller's select, racing exactly as FetchCtx/MetadataCtx/... do:
+	// ctx is already done, so this case is the one that is free to fire.
+	select {
+	case <-respc:
+	case <-ctx.Done():
+		c.abortWaiter(1)
+	}
+
+	// A second, unrelated request must still be servable: the reader
+	// goroutine (simulated here by the send above) was never blocked.
+	if _, err := c.respWaiter(2); err != nil {
+		t.Fatalf("respWaiter(2) after the race: %s", err)
+	}
+}
+
+// TestOutOfOrderWaitDoesNotBlockDelivery exercises the async API's
+// documented use case: issue several requests from one goroutine, then
+// Wait on them in whatever order is convenient, not necessarily the order
+// they were issued or will complete in. Kafka delivers responses in
+// request order and readRespLoop delivers them synchronously, so with an
+// unbuffered respc this deadlocks as soon as a later response is waited on
+// before an earlier one. The cap-1 buffer lets the reader deliver both
+// results up front regardless of Wait order.
+func TestOutOfOrderWaitDoesNotBlockDelivery(t *testing.T) {
+	c := newTestConnection()
+
+	respc1, err := c.respWaiter(1)
+	if err != nil {
+		t.Fatalf("respWaiter(1): %s", err)
+	}
+	respc2, err := c.respWaiter(2)
+	if err != nil {
+		t.Fatalf("respWaiter(2): %s", err)
+	}
+
+	// readRespLoop delivers responses as they arrive on the wire, in
+	// request order, without waiting for anyone to be ready to receive.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		respc1 <- result{body: []byte("first")}
+		close(respc1)
+		respc2 <- result{body: []byte("second")}
+		close(respc2)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("readRespLoop blocked delivering responses in request order")
+	}
+
+	// The caller waits on the second future first -- out of order -- and
+	// must not have been the thing the reader was blocked on above.
+	res2 := <-respc2
+	if string(res2.body) != "second" {
+		t.Fatalf("res2.body = %q, want %q", res2.body, "second")
+	}
+	res1 := <-respc1
+	if string(res1.body) != "first" {
+		t.Fatalf("res1.body = %q, want %q", res1.body, "first")
+	}
+}
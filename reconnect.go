@@ -0,0 +1,114 @@
+package kafka
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ReconnectPolicy enables self-healing of a connection: instead of
+// terminally closing the socket on the first transient error, readRespLoop
+// hands off to reconnect, which drains in-flight waiters with
+// ErrReconnecting, redials the broker with exponential backoff and resumes
+// reading once the new socket is up. This lets a long-lived consumer
+// survive a broker rolling restart without help from the Broker layer.
+type ReconnectPolicy struct {
+	// MaxBackoff bounds the exponential backoff applied between redial
+	// attempts. Backoff starts at 100ms (or at this value, if smaller) and
+	// doubles, jittered, up to this value. A zero value defaults to 30s.
+	MaxBackoff time.Duration
+}
+
+const minBackoff = 100 * time.Millisecond
+
+// isTransientErr reports whether err is the kind of error a ReconnectPolicy
+// should redial on, rather than surface as a terminal ErrClosed.
+func isTransientErr(err error) bool {
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return false
+}
+
+// jitter returns a randomized duration in [d/2, d), so that many
+// connections backing off at once do not redial in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d-d/2)))
+}
+
+// reconnect drains the in-flight waiters with ErrReconnecting, closes the
+// dead socket and redials the broker with exponential backoff, replaying
+// the TLS/SASL handshake, until a new connection is established, or the
+// connection is permanently closed concurrently -- either while still
+// waiting out the backoff (via c.stop) or right after a successful redial
+// (checked against c.closed before the new socket is published).
+func (c *connection) reconnect(cause error) error {
+	c.mu.Lock()
+	if c.closed {
+		err := c.stopErr
+		c.mu.Unlock()
+		return err
+	}
+	rw := c.rw
+	c.mu.Unlock()
+	_ = rw.Close()
+
+	c.drainWaiters(ErrReconnecting)
+
+	log.Printf("kafka: connection to %s lost (%s), reconnecting", c.address, cause)
+
+	maxBackoff := c.conf.ReconnectPolicy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+
+	backoff := minBackoff
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	for {
+		select {
+		case <-c.stop:
+			return ErrClosed
+		case <-time.After(jitter(backoff)):
+		}
+
+		rw, rd, err := dialConnection(c.address, c.timeout, c.conf)
+		if err == nil {
+			c.mu.Lock()
+			if c.closed {
+				// Close() happened while we were redialing; give up and
+				// honor the terminal error instead.
+				err := c.stopErr
+				c.mu.Unlock()
+				_ = rw.Close()
+				return err
+			}
+			c.rw = rw
+			c.rd = rd
+			c.mu.Unlock()
+			log.Printf("kafka: reconnected to %s", c.address)
+			return nil
+		}
+
+		log.Printf("kafka: reconnecting to %s failed: %s", c.address, err)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
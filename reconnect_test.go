@@ -0,0 +1,58 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestJitterBounds(t *testing.T) {
+	const d = 200 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		got := jitter(d)
+		if got < d/2 || got >= d {
+			t.Fatalf("jitter(%s) = %s, want in [%s, %s)", d, got, d/2, d)
+		}
+	}
+}
+
+func TestJitterNonPositive(t *testing.T) {
+	if got := jitter(0); got != 0 {
+		t.Fatalf("jitter(0) = %s, want 0", got)
+	}
+	if got := jitter(-time.Second); got != 0 {
+		t.Fatalf("jitter(negative) = %s, want 0", got)
+	}
+}
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestIsTransientErr(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"eof", io.EOF, true},
+		{"wrapped eof", fmt.Errorf("read: %w", io.EOF), true},
+		{"econnreset", syscall.ECONNRESET, true},
+		{"net timeout", &net.OpError{Err: timeoutErr{}}, true},
+		{"unrelated", errors.New("boom"), false},
+		{"nil", nil, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isTransientErr(c.err); got != c.want {
+				t.Errorf("isTransientErr(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package kafka
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestSaslAuthenticatePlainFraming(t *testing.T) {
+	var wire bytes.Buffer
+	var resp bytes.Buffer
+	_ = binary.Write(&resp, binary.BigEndian, int32(0)) // empty body: success
+
+	auth := &SASLAuth{Mechanism: "PLAIN", User: "alice", Password: "secret"}
+	if err := saslAuthenticate(&wire, bufio.NewReader(&resp), auth); err != nil {
+		t.Fatalf("saslAuthenticate: %s", err)
+	}
+
+	var size int32
+	if err := binary.Read(&wire, binary.BigEndian, &size); err != nil {
+		t.Fatalf("reading written size: %s", err)
+	}
+	token := make([]byte, size)
+	if _, err := wire.Read(token); err != nil {
+		t.Fatalf("reading written token: %s", err)
+	}
+	want := "\x00alice\x00secret"
+	if string(token) != want {
+		t.Fatalf("token = %q, want %q", token, want)
+	}
+}
+
+func TestSaslAuthenticateFailureResponse(t *testing.T) {
+	var wire bytes.Buffer
+	var resp bytes.Buffer
+	_ = binary.Write(&resp, binary.BigEndian, int32(len("bad credentials")))
+	resp.WriteString("bad credentials")
+
+	auth := &SASLAuth{Mechanism: "PLAIN", User: "alice", Password: "wrong"}
+	if err := saslAuthenticate(&wire, bufio.NewReader(&resp), auth); err == nil {
+		t.Fatal("expected an error for a non-empty SASL response, got nil")
+	}
+}
+
+func TestSaslAuthenticateRejectsUnsupportedMechanism(t *testing.T) {
+	var wire bytes.Buffer
+	auth := &SASLAuth{Mechanism: "GSSAPI"}
+	if err := saslAuthenticate(&wire, bufio.NewReader(&bytes.Buffer{}), auth); err == nil {
+		t.Fatal("expected an error for an unsupported mechanism, got nil")
+	}
+	if wire.Len() != 0 {
+		t.Fatal("unsupported mechanism must not write anything to the wire")
+	}
+}
@@ -0,0 +1,126 @@
+package kafka
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+
+	"github.com/optiopay/kafka/proto"
+)
+
+// startSpan starts a child span for a Kafka RPC named "kafka.<op>",
+// adopting the span carried by ctx (if any) as its parent so that traces
+// started higher up -- an HTTP handler, say -- continue through the
+// producer/consumer down to the broker round trip. The returned span must
+// be finished by the caller.
+func (c *connection) startSpan(ctx context.Context, op string) opentracing.Span {
+	var opts []opentracing.StartSpanOption
+	if parent := opentracing.SpanFromContext(ctx); parent != nil {
+		opts = append(opts, opentracing.ChildOf(parent.Context()))
+	}
+	span := c.tracer.StartSpan("kafka."+op, opts...)
+	if cn, ok := c.conn().(net.Conn); ok {
+		span.SetTag("peer.address", cn.RemoteAddr().String())
+	}
+	return span
+}
+
+// spanErrorf marks span as failed and logs err, used whenever a waiting
+// request is unblocked by the connection's stopErr rather than a decoded
+// response.
+func spanErrorf(span opentracing.Span, err error) {
+	if err == nil {
+		return
+	}
+	ext.Error.Set(span, true)
+	span.LogKV("event", "error", "message", err.Error())
+}
+
+// tagTopicPartitions tags span with the topics and partitions an RPC
+// covers, so a trace shows which data was touched rather than only which
+// method was called. Either slice may be empty, e.g. for a request that
+// covers no partitions.
+func tagTopicPartitions(span opentracing.Span, topics []string, partitions []int32) {
+	if len(topics) > 0 {
+		span.SetTag("kafka.topic", strings.Join(topics, ","))
+	}
+	if len(partitions) > 0 {
+		parts := make([]string, len(partitions))
+		for i, p := range partitions {
+			parts[i] = strconv.Itoa(int(p))
+		}
+		span.SetTag("kafka.partition", strings.Join(parts, ","))
+	}
+}
+
+// produceTopicPartitions flattens a ProduceReq's topics into the shape
+// tagTopicPartitions expects.
+func produceTopicPartitions(topics []proto.ProduceReqTopic) ([]string, []int32) {
+	names := make([]string, len(topics))
+	var partitions []int32
+	for i, t := range topics {
+		names[i] = t.Name
+		for _, p := range t.Partitions {
+			partitions = append(partitions, p.Partition)
+		}
+	}
+	return names, partitions
+}
+
+// fetchTopicPartitions flattens a FetchReq's topics into the shape
+// tagTopicPartitions expects.
+func fetchTopicPartitions(topics []proto.FetchReqTopic) ([]string, []int32) {
+	names := make([]string, len(topics))
+	var partitions []int32
+	for i, t := range topics {
+		names[i] = t.Name
+		for _, p := range t.Partitions {
+			partitions = append(partitions, p.Partition)
+		}
+	}
+	return names, partitions
+}
+
+// offsetTopicPartitions flattens an OffsetReq's topics into the shape
+// tagTopicPartitions expects.
+func offsetTopicPartitions(topics []proto.OffsetReqTopic) ([]string, []int32) {
+	names := make([]string, len(topics))
+	var partitions []int32
+	for i, t := range topics {
+		names[i] = t.Name
+		for _, p := range t.Partitions {
+			partitions = append(partitions, p.Partition)
+		}
+	}
+	return names, partitions
+}
+
+// offsetCommitTopicPartitions flattens an OffsetCommitReq's topics into the
+// shape tagTopicPartitions expects.
+func offsetCommitTopicPartitions(topics []proto.OffsetCommitReqTopic) ([]string, []int32) {
+	names := make([]string, len(topics))
+	var partitions []int32
+	for i, t := range topics {
+		names[i] = t.Name
+		for _, p := range t.Partitions {
+			partitions = append(partitions, p.Partition)
+		}
+	}
+	return names, partitions
+}
+
+// offsetFetchTopicPartitions flattens an OffsetFetchReq's topics into the
+// shape tagTopicPartitions expects.
+func offsetFetchTopicPartitions(topics []proto.OffsetFetchReqTopic) ([]string, []int32) {
+	names := make([]string, len(topics))
+	var partitions []int32
+	for i, t := range topics {
+		names[i] = t.Name
+		partitions = append(partitions, t.Partitions...)
+	}
+	return names, partitions
+}